@@ -1,26 +1,39 @@
 package main
 
 import (
-	"bytes"
-	"container/list"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/marksamman/bencode"
 	"golang.org/x/time/rate"
+
+	"github.com/wanghui22718/torsniff/krpc"
 )
 
+var errMalformedReply = errors.New("dht: malformed reply")
+
 var seed = []string{
 	"router.bittorrent.com:6881",
 	"dht.transmissionbt.com:6881",
 	"router.utorrent.com:6881",
 }
 
+const (
+	callTimeout = 5 * time.Second
+	callRetries = 1
+
+	// secretRotationInterval is how often we replace the token secret, per
+	// BEP 5's recommendation of "every five minutes or so".
+	secretRotationInterval = 5 * time.Minute
+)
+
 type nodeID []byte
 
 type node struct {
@@ -36,6 +49,54 @@ type announcement struct {
 	infohashHex string
 }
 
+const (
+	// perPeerAnnouncementCap bounds how many announcements we'll hold for
+	// a single peer before dropping its oldest one, so one noisy peer
+	// can't starve the others.
+	perPeerAnnouncementCap = 64
+	scheduleInterval       = 10 * time.Millisecond
+
+	// peerIdleGracePeriod is how long a peer's queue can sit empty before
+	// we stop tracking it, so the set of tracked peers reflects the
+	// currently-active swarm instead of growing for every distinct
+	// source IP ever seen over the process's lifetime.
+	peerIdleGracePeriod = 2 * time.Minute
+)
+
+// announcementQueue is a small bounded FIFO queue of announcements from a
+// single peer. It isn't safe for concurrent use; callers serialize access
+// via dht.announceMu.
+type announcementQueue struct {
+	items      []*announcement
+	lastActive time.Time
+}
+
+func (q *announcementQueue) push(ac *announcement) (dropped bool) {
+	q.lastActive = time.Now()
+	if len(q.items) >= perPeerAnnouncementCap {
+		q.items = q.items[1:]
+		dropped = true
+	}
+	q.items = append(q.items, ac)
+	return dropped
+}
+
+func (q *announcementQueue) pop() *announcement {
+	if len(q.items) == 0 {
+		return nil
+	}
+	ac := q.items[0]
+	q.items = q.items[1:]
+	return ac
+}
+
+// Stats is a point-in-time snapshot of the announcement scheduler's
+// backlog, suitable for exposing over expvar or similar.
+type Stats struct {
+	Pending int
+	Drops   map[string]int64
+}
+
 func randBytes(n int) []byte {
 	b := make([]byte, n)
 	rand.Read(b)
@@ -50,23 +111,6 @@ func neighborID(target nodeID, local nodeID) nodeID {
 	return id
 }
 
-func makeQuery(tid string, q string, a map[string]interface{}) map[string]interface{} {
-	return map[string]interface{}{
-		"t": tid,
-		"y": "q",
-		"q": q,
-		"a": a,
-	}
-}
-
-func makeReply(tid string, r map[string]interface{}) map[string]interface{} {
-	return map[string]interface{}{
-		"t": tid,
-		"y": "r",
-		"r": r,
-	}
-}
-
 func decodeNodes(s string) (nodes []*node) {
 	length := len(s)
 	if length%26 != 0 {
@@ -89,115 +133,286 @@ func per(events int, duration time.Duration) rate.Limit {
 }
 
 type dht struct {
-	announcements        *list.List
-	announcementNotifier chan struct{}
-	chNode               chan *node
-	die                  chan struct{}
-	errDie               error
-	localID              nodeID
-	conn                 *net.UDPConn
-	queryTypes           map[string]func(map[string]interface{}, net.UDPAddr)
-	friendsLimiter       *rate.Limiter
-	maxAnnouncements     int
-	secret               string
-	bootstraps           []string
-}
-
-func newDHT(laddr string, maxFriendsPerSec int) (*dht, error) {
+	announceOut     chan *announcement
+	announceMu      sync.Mutex
+	announceQueues  map[string]*announcementQueue
+	announcePeers   []string
+	pending         int
+	drops           map[string]int64
+	chNode          chan *node
+	die             chan struct{}
+	errDie          error
+	localIDMu       sync.RWMutex
+	localID         nodeID
+	transport       *krpc.Transport
+	friendsLimiter  *rate.Limiter
+	secretMu        sync.RWMutex
+	secret          string
+	prevSecret      string
+	bootstraps      []string
+	bootstrapIPs    map[string]bool
+	requireSecureID bool
+}
+
+// newDHT starts a DHT node listening on laddr. externalIP, if not nil,
+// seeds the node's id with a BEP 42 secure derivation; if it's nil and
+// autodetectExternalIP is true, the node instead learns its external IP
+// from the bootstrap routers' replies and adopts a secure id once it
+// does. requireSecureID controls whether get_peers/announce_peer queries
+// from peers with a non-compliant BEP 42 id are rejected outright: most
+// of the real mainline DHT still doesn't implement BEP 42, so a sniffer
+// wants this off by default and only set for callers that specifically
+// want to filter the swarm down to compliant peers.
+func newDHT(laddr string, maxFriendsPerSec int, externalIP net.IP, autodetectExternalIP bool, requireSecureID bool) (*dht, error) {
 	conn, err := net.ListenPacket("udp4", laddr)
 	if err != nil {
 		return nil, err
 	}
 
 	g := &dht{
-		announcements: list.New(),
-		localID:       randBytes(20),
-		conn:          conn.(*net.UDPConn),
-		chNode:        make(chan *node),
-		die:           make(chan struct{}),
-		secret:        string(randBytes(20)),
-		bootstraps:    seed,
-	}
-	g.maxAnnouncements = maxFriendsPerSec * 10
-	g.friendsLimiter = rate.NewLimiter(per(maxFriendsPerSec, time.Second), maxFriendsPerSec)
-	g.announcementNotifier = make(chan struct{}, 1)
-	g.queryTypes = map[string]func(map[string]interface{}, net.UDPAddr){
-		"get_peers":     g.onGetPeersQuery,
-		"announce_peer": g.onAnnouncePeerQuery,
+		announceOut:     make(chan *announcement),
+		announceQueues:  make(map[string]*announcementQueue),
+		drops:           make(map[string]int64),
+		localID:         initialLocalID(externalIP),
+		transport:       krpc.NewTransport(conn.(*net.UDPConn), callTimeout, callRetries),
+		chNode:          make(chan *node),
+		die:             make(chan struct{}),
+		secret:          string(randBytes(20)),
+		bootstraps:      seed,
+		bootstrapIPs:    resolveBootstrapIPs(seed),
+		requireSecureID: requireSecureID,
 	}
+	g.friendsLimiter = rate.NewLimiter(per(maxFriendsPerSec, time.Second), maxFriendsPerSec)
+	g.transport.Handle("get_peers", g.onGetPeersQuery)
+	g.transport.Handle("announce_peer", g.onAnnouncePeerQuery)
 
 	go g.listen()
 	go g.join()
 	go g.makefriends()
+	go g.scheduleAnnouncements()
+	go g.rotateSecret()
+
+	if externalIP == nil && autodetectExternalIP {
+		go g.adoptDetectedExternalID()
+	}
 
 	return g, nil
 }
 
-func (g *dht) listen() {
-	buf := make([]byte, 2048)
-	for {
-		n, addr, err := g.conn.ReadFromUDP(buf)
-		if err == nil {
-			g.onMessage(buf[:n], *addr)
-		} else {
-			g.errDie = err
-			close(g.die)
-			break
+func resolveBootstrapIPs(bootstraps []string) map[string]bool {
+	ips := make(map[string]bool, len(bootstraps))
+	for _, addr := range bootstraps {
+		raddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			continue
 		}
+		ips[raddr.IP.String()] = true
 	}
+	return ips
 }
 
-func (g *dht) join() {
-	const timesForSure = 3
-	for i := 0; i < timesForSure; i++ {
-		for _, addr := range g.bootstraps {
-			g.chNode <- &node{addr: addr, id: string(randBytes(20))}
-		}
-	}
+func (g *dht) getLocalID() nodeID {
+	g.localIDMu.RLock()
+	defer g.localIDMu.RUnlock()
+	return g.localID
+}
+
+func (g *dht) setLocalID(id nodeID) {
+	g.localIDMu.Lock()
+	defer g.localIDMu.Unlock()
+	g.localID = id
 }
 
-func (g *dht) onMessage(data []byte, from net.UDPAddr) {
-	dict, err := bencode.Decode(bytes.NewBuffer(data))
+// adoptDetectedExternalID learns the node's external IP from the
+// bootstrap routers' replies and switches to a BEP 42 secure id derived
+// from it, so the node is well-behaved even when started behind NAT
+// without being told its public address up front.
+func (g *dht) adoptDetectedExternalID() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ip, err := g.detectExternalIP(ctx)
 	if err != nil {
 		return
 	}
 
-	y, ok := dict["y"].(string)
-	if !ok {
-		return
+	g.setLocalID(secureNodeID(ip, randBytes(1)[0]))
+}
+
+// detectExternalIP queries the bootstrap routers and returns the
+// external address the first one to answer reports back to us, using
+// the same "ip" reply extension mainline and libtorrent nodes use for
+// this purpose.
+func (g *dht) detectExternalIP(ctx context.Context) (net.IP, error) {
+	var lastErr error
+	for _, addr := range g.bootstraps {
+		raddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := g.transport.Call(ctx, *raddr, "ping", map[string]interface{}{
+			"id": string(g.getLocalID()),
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ip, _, ok := decodeCompactAddr(resp.IP)
+		if !ok {
+			continue
+		}
+
+		return ip, nil
 	}
 
-	switch y {
-	case "q":
-		g.onQuery(dict, from)
-	case "r", "e":
-		g.onReply(dict, from)
+	if lastErr == nil {
+		lastErr = errors.New("dht: no bootstrap router reported our external ip")
 	}
+	return nil, lastErr
 }
 
-func (g *dht) onQuery(dict map[string]interface{}, from net.UDPAddr) {
-	_, ok := dict["t"].(string)
-	if !ok {
-		return
+func decodeCompactAddr(s string) (ip net.IP, port int, ok bool) {
+	if len(s) != 6 {
+		return nil, 0, false
 	}
+	return net.IP([]byte(s[:4])), int(binary.BigEndian.Uint16([]byte(s[4:6]))), true
+}
+
+// Announcements returns the channel announce_peer queries are delivered
+// on, fairly interleaved across the peers that sent them: every
+// scheduler tick forwards one pending announcement per active peer.
+func (g *dht) Announcements() <-chan *announcement {
+	return g.announceOut
+}
+
+// Stats reports the current announcement backlog and the drop count per
+// peer, for monitoring how much backpressure peers are causing.
+func (g *dht) Stats() Stats {
+	g.announceMu.Lock()
+	defer g.announceMu.Unlock()
+
+	drops := make(map[string]int64, len(g.drops))
+	for peer, n := range g.drops {
+		drops[peer] = n
+	}
+
+	return Stats{Pending: g.pending, Drops: drops}
+}
+
+// enqueueAnnouncement appends ac to its peer's bounded queue, dropping
+// the peer's oldest pending announcement if the queue is already full.
+func (g *dht) enqueueAnnouncement(peer string, ac *announcement) {
+	g.announceMu.Lock()
+	defer g.announceMu.Unlock()
 
-	q, ok := dict["q"].(string)
+	q, ok := g.announceQueues[peer]
 	if !ok {
-		return
+		q = &announcementQueue{}
+		g.announceQueues[peer] = q
+		g.announcePeers = append(g.announcePeers, peer)
 	}
 
-	if handle, ok := g.queryTypes[q]; ok {
-		handle(dict, from)
+	if q.push(ac) {
+		g.drops[peer]++
+	} else {
+		g.pending++
 	}
 }
 
-func (g *dht) onReply(dict map[string]interface{}, from net.UDPAddr) {
-	r, ok := dict["r"].(map[string]interface{})
-	if !ok {
+// dequeueRound takes one announcement from every peer that currently has
+// one pending, so a single tick's worth of work scales with the number
+// of active peers instead of being capped at one announcement total. It
+// also evicts any peer whose queue has been empty for longer than
+// peerIdleGracePeriod, so tracked-peer state doesn't grow forever across
+// the swarm's constant churn.
+func (g *dht) dequeueRound() []*announcement {
+	g.announceMu.Lock()
+	defer g.announceMu.Unlock()
+
+	out := make([]*announcement, 0, len(g.announcePeers))
+	now := time.Now()
+
+	live := g.announcePeers[:0]
+	for _, peer := range g.announcePeers {
+		q := g.announceQueues[peer]
+		if ac := q.pop(); ac != nil {
+			g.pending--
+			out = append(out, ac)
+		}
+
+		if len(q.items) == 0 && now.Sub(q.lastActive) > peerIdleGracePeriod {
+			delete(g.announceQueues, peer)
+			delete(g.drops, peer)
+			continue
+		}
+		live = append(live, peer)
+	}
+	g.announcePeers = live
+
+	return out
+}
+
+// scheduleAnnouncements drains one announcement per active peer per tick
+// and forwards each to announceOut, so a single peer can never
+// monopolize the output stream.
+func (g *dht) scheduleAnnouncements() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, ac := range g.dequeueRound() {
+			g.announceOut <- ac
+		}
+	}
+}
+
+func (g *dht) listen() {
+	g.errDie = g.transport.Listen()
+	close(g.die)
+}
+
+func (g *dht) join() {
+	const timesForSure = 3
+	for i := 0; i < timesForSure; i++ {
+		for _, addr := range g.bootstraps {
+			g.chNode <- &node{addr: addr, id: string(randBytes(20))}
+		}
+	}
+}
+
+// findNode asks to for nodes close to a random target, presenting an id
+// that neighbors target, and, once the reply arrives, feeds them back into
+// the friend-making pipeline. The query is a krpc.Call so its reply can
+// be correlated with the request that produced it.
+func (g *dht) findNode(to string, target nodeID) {
+	addr, err := net.ResolveUDPAddr("udp4", to)
+	if err != nil {
 		return
 	}
 
-	nodes, ok := r["nodes"].(string)
+	args := map[string]interface{}{
+		"id":     string(neighborID(target, g.getLocalID())),
+		"target": string(randBytes(20)),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout*time.Duration(callRetries+1))
+		defer cancel()
+
+		resp, err := g.transport.Call(ctx, *addr, "find_node", args)
+		if err != nil {
+			return
+		}
+
+		g.onFindNodeReply(resp)
+	}()
+}
+
+func (g *dht) onFindNodeReply(resp *krpc.Response) {
+	nodes, ok := resp.R["nodes"].(string)
 	if !ok {
 		return
 	}
@@ -211,85 +426,110 @@ func (g *dht) onReply(dict map[string]interface{}, from net.UDPAddr) {
 	}
 }
 
-func (g *dht) findNode(to string, target nodeID) {
-	d := makeQuery(string(randBytes(2)), "find_node", map[string]interface{}{
-		"id":     string(neighborID(target, g.localID)),
-		"target": string(randBytes(20)),
+// Ping queries addr for its node id, confirming it's alive and
+// reachable.
+func (g *dht) Ping(ctx context.Context, addr net.UDPAddr) (nodeID, error) {
+	resp, err := g.transport.Call(ctx, addr, "ping", map[string]interface{}{
+		"id": string(g.getLocalID()),
 	})
-
-	addr, err := net.ResolveUDPAddr("udp4", to)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	g.send(d, *addr)
+	id, ok := resp.R["id"].(string)
+	if !ok {
+		return nil, errMalformedReply
+	}
+
+	return nodeID(id), nil
 }
 
-func (g *dht) onGetPeersQuery(dict map[string]interface{}, from net.UDPAddr) {
-	tid := dict["t"].(string)
-	a, ok := dict["a"].(map[string]interface{})
-	if !ok {
-		return
+// GetPeers asks addr for peers announcing infohash, returning their raw
+// compact contact strings along with the token a subsequent
+// announce_peer to addr must present.
+func (g *dht) GetPeers(ctx context.Context, addr net.UDPAddr, infohash []byte) (peers []string, token string, err error) {
+	resp, err := g.transport.Call(ctx, addr, "get_peers", map[string]interface{}{
+		"id":        string(g.getLocalID()),
+		"info_hash": string(infohash),
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
-	id, ok := a["id"].(string)
+	token, _ = resp.R["token"].(string)
+
+	values, ok := resp.R["values"].([]interface{})
 	if !ok {
-		return
+		return nil, token, nil
 	}
 
-	d := makeReply(tid, map[string]interface{}{
-		"id":    string(neighborID([]byte(id), g.localID)),
-		"nodes": "",
-		"token": g.genToken(from),
-	})
-	g.send(d, from)
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			peers = append(peers, s)
+		}
+	}
+
+	return peers, token, nil
 }
 
-func (g *dht) onAnnouncePeerQuery(dict map[string]interface{}, from net.UDPAddr) {
-	if g.announcements.Len() >= g.maxAnnouncements {
+func (g *dht) onGetPeersQuery(q *krpc.Query, from net.UDPAddr) {
+	id, ok := q.A["id"].(string)
+	if !ok || !g.acceptsPeerID([]byte(id), from) {
 		return
 	}
 
-	a, ok := dict["a"].(map[string]interface{})
-	if !ok {
+	g.transport.Reply(q.T, map[string]interface{}{
+		"id":    string(neighborID([]byte(id), g.getLocalID())),
+		"nodes": "",
+		"token": g.genToken(from),
+	}, from)
+}
+
+func (g *dht) onAnnouncePeerQuery(q *krpc.Query, from net.UDPAddr) {
+	id, ok := q.A["id"].(string)
+	if !ok || !g.acceptsPeerID([]byte(id), from) {
 		return
 	}
 
-	token, ok := a["token"].(string)
+	token, ok := q.A["token"].(string)
 	if !ok || !g.validateToken(token, from) {
 		return
 	}
 
-	if ac := g.summarize(dict, from); ac != nil {
-		g.announcements.PushBack(ac)
-
-		select {
-		case g.announcementNotifier <- struct{}{}:
-		default:
-		}
+	if ac := g.summarize(q, from); ac != nil {
+		g.enqueueAnnouncement(from.IP.String(), ac)
 	}
 }
 
-func (g *dht) summarize(dict map[string]interface{}, from net.UDPAddr) *announcement {
-	a, ok := dict["a"].(map[string]interface{})
-	if !ok {
-		return nil
+// acceptsPeerID reports whether id is a well-formed node id to accept a
+// query from. Unless requireSecureID is set, every id is accepted: most
+// of the real-world DHT still hasn't adopted BEP 42, and a sniffer whose
+// purpose is observing announce_peer traffic shouldn't silently discard
+// most of it over an ID-format preference. When requireSecureID is set,
+// a BEP 42 secure id matching from's address is required, except from
+// our bootstrap routers, which predate BEP 42 and needn't comply.
+func (g *dht) acceptsPeerID(id []byte, from net.UDPAddr) bool {
+	if !g.requireSecureID || g.bootstrapIPs[from.IP.String()] {
+		return true
 	}
+	return validSecureNodeID(id, from.IP)
+}
 
-	infohash, ok := a["info_hash"].(string)
+func (g *dht) summarize(q *krpc.Query, from net.UDPAddr) *announcement {
+	infohash, ok := q.A["info_hash"].(string)
 	if !ok {
 		return nil
 	}
 
 	port := int64(from.Port)
-	if impliedPort, ok := a["implied_port"].(int64); ok && impliedPort == 0 {
-		if p, ok := a["port"].(int64); ok {
+	if impliedPort, ok := q.A["implied_port"].(int64); ok && impliedPort == 0 {
+		if p, ok := q.A["port"].(int64); ok {
 			port = p
 		}
 	}
 
 	return &announcement{
-		raw:         dict,
+		raw:         q.A,
 		from:        from,
 		infohash:    []byte(infohash),
 		infohashHex: hex.EncodeToString([]byte(infohash)),
@@ -297,11 +537,6 @@ func (g *dht) summarize(dict map[string]interface{}, from net.UDPAddr) *announce
 	}
 }
 
-func (g *dht) send(dict map[string]interface{}, to net.UDPAddr) error {
-	g.conn.WriteToUDP(bencode.Encode(dict), &to)
-	return nil
-}
-
 func (g *dht) makefriends() {
 	for {
 		node := <-g.chNode
@@ -309,13 +544,48 @@ func (g *dht) makefriends() {
 	}
 }
 
-func (g *dht) genToken(from net.UDPAddr) string {
+// rotateSecret replaces the current token secret every
+// secretRotationInterval, keeping the outgoing one around as prevSecret
+// so tokens handed out just before a rotation still validate for one
+// more rotation period, per BEP 5.
+func (g *dht) rotateSecret() {
+	ticker := time.NewTicker(secretRotationInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.secretMu.Lock()
+		g.prevSecret = g.secret
+		g.secret = string(randBytes(20))
+		g.secretMu.Unlock()
+	}
+}
+
+func (g *dht) tokenHash(from net.UDPAddr, secret string) string {
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(from.Port))
+
 	s := sha1.New()
 	s.Write(from.IP)
-	s.Write([]byte(g.secret))
+	s.Write(port)
+	s.Write([]byte(secret))
 	return string(s.Sum(nil))
 }
 
+func (g *dht) genToken(from net.UDPAddr) string {
+	g.secretMu.RLock()
+	defer g.secretMu.RUnlock()
+	return g.tokenHash(from, g.secret)
+}
+
+// validateToken accepts a token generated from either the current secret
+// or the one it replaced, so a token issued just before a rotation still
+// validates immediately after.
 func (g *dht) validateToken(token string, from net.UDPAddr) bool {
-	return token == g.genToken(from)
+	g.secretMu.RLock()
+	defer g.secretMu.RUnlock()
+
+	if token == g.tokenHash(from, g.secret) {
+		return true
+	}
+	return g.prevSecret != "" && token == g.tokenHash(from, g.prevSecret)
 }
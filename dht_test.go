@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestValidateTokenAcrossRotation verifies a token issued just before a
+// secret rotation still validates immediately after it, since the
+// rotated-out secret is kept around as prevSecret for exactly that
+// reason.
+func TestValidateTokenAcrossRotation(t *testing.T) {
+	g := &dht{secret: string(randBytes(20))}
+	from := net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 6881}
+
+	token := g.genToken(from)
+
+	g.secretMu.Lock()
+	g.prevSecret = g.secret
+	g.secret = string(randBytes(20))
+	g.secretMu.Unlock()
+
+	if !g.validateToken(token, from) {
+		t.Fatal("token issued before rotation did not validate after it")
+	}
+}
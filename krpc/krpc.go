@@ -0,0 +1,246 @@
+// Package krpc implements the KRPC protocol (BEP 5) used by the
+// BitTorrent DHT: bencoded queries, responses and errors exchanged over
+// UDP, with a transaction table so outgoing queries can be correlated
+// with their replies instead of being handled fire-and-forget.
+package krpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+// Query is a KRPC query ("q" message), either one we received or one we
+// are about to send.
+type Query struct {
+	T string
+	Q string
+	A map[string]interface{}
+}
+
+// Response is a successful KRPC reply ("r" message). IP carries the
+// top-level "ip" key some DHT nodes (mainline, libtorrent) include in
+// their replies: a compact node address for whatever address they saw
+// the query arrive from, letting the querier learn its own external IP.
+type Response struct {
+	T  string
+	R  map[string]interface{}
+	IP string
+}
+
+// Error is a KRPC error reply ("e" message).
+type Error struct {
+	T       string
+	Code    int64
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc: peer returned error %d: %s", e.Code, e.Message)
+}
+
+// ErrTimeout is returned by Call once every attempt has gone unanswered.
+var ErrTimeout = errors.New("krpc: call timed out")
+
+// QueryHandler answers an incoming query from a peer.
+type QueryHandler func(q *Query, from net.UDPAddr)
+
+type pendingCall struct {
+	reply chan *Response
+	err   chan error
+}
+
+// Transport multiplexes KRPC traffic over a single UDP socket. It keeps
+// a table of outstanding transactions so a reply can be routed back to
+// the Call that sent the matching query, and dispatches incoming queries
+// to registered handlers by method name.
+type Transport struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	retries int
+
+	mu      sync.Mutex
+	pending map[string]*pendingCall
+
+	handlersMu sync.RWMutex
+	handlers   map[string]QueryHandler
+}
+
+// NewTransport wraps conn. Each Call retries up to retries times,
+// waiting up to timeout for a reply on every attempt.
+func NewTransport(conn *net.UDPConn, timeout time.Duration, retries int) *Transport {
+	return &Transport{
+		conn:     conn,
+		timeout:  timeout,
+		retries:  retries,
+		pending:  make(map[string]*pendingCall),
+		handlers: make(map[string]QueryHandler),
+	}
+}
+
+// Handle registers handler to answer incoming queries whose "q" field is
+// method, replacing any handler previously registered for it.
+func (t *Transport) Handle(method string, handler QueryHandler) {
+	t.handlersMu.Lock()
+	defer t.handlersMu.Unlock()
+	t.handlers[method] = handler
+}
+
+// Listen reads packets off the socket until it errors (typically because
+// it was closed), dispatching each one to a waiting Call or a registered
+// QueryHandler. It returns the read error.
+func (t *Transport) Listen() error {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		t.dispatch(buf[:n], *from)
+	}
+}
+
+func (t *Transport) dispatch(data []byte, from net.UDPAddr) {
+	dict, err := bencode.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+
+	tid, _ := dict["t"].(string)
+
+	switch dict["y"] {
+	case "q":
+		method, ok := dict["q"].(string)
+		if !ok {
+			return
+		}
+		a, _ := dict["a"].(map[string]interface{})
+
+		t.handlersMu.RLock()
+		handler, ok := t.handlers[method]
+		t.handlersMu.RUnlock()
+		if ok {
+			handler(&Query{T: tid, Q: method, A: a}, from)
+		}
+
+	case "r":
+		r, ok := dict["r"].(map[string]interface{})
+		if ok {
+			ip, _ := dict["ip"].(string)
+			t.deliver(tid, &Response{T: tid, R: r, IP: ip}, nil)
+		}
+
+	case "e":
+		e, ok := dict["e"].([]interface{})
+		if ok && len(e) == 2 {
+			code, _ := e[0].(int64)
+			msg, _ := e[1].(string)
+			t.deliver(tid, nil, &Error{T: tid, Code: code, Message: msg})
+		}
+	}
+}
+
+func (t *Transport) deliver(tid string, r *Response, err error) {
+	t.mu.Lock()
+	call, ok := t.pending[tid]
+	if ok {
+		delete(t.pending, tid)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		call.err <- err
+	} else {
+		call.reply <- r
+	}
+}
+
+// Call sends a query for method/args to addr and blocks until a reply
+// arrives, ctx is cancelled, or every retry has timed out without one.
+func (t *Transport) Call(ctx context.Context, addr net.UDPAddr, method string, args map[string]interface{}) (*Response, error) {
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		tid, call := t.reserve()
+
+		q := &Query{T: tid, Q: method, A: args}
+		if _, err := t.conn.WriteToUDP(encodeQuery(q), &addr); err != nil {
+			t.forget(tid)
+			return nil, err
+		}
+
+		select {
+		case r := <-call.reply:
+			return r, nil
+		case err := <-call.err:
+			return nil, err
+		case <-time.After(t.timeout):
+			t.forget(tid)
+			continue
+		case <-ctx.Done():
+			t.forget(tid)
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, ErrTimeout
+}
+
+func (t *Transport) forget(tid string) {
+	t.mu.Lock()
+	delete(t.pending, tid)
+	t.mu.Unlock()
+}
+
+// Reply sends r as the successful response to the query transaction tid.
+func (t *Transport) Reply(tid string, r map[string]interface{}, addr net.UDPAddr) error {
+	d := map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": r,
+	}
+	_, err := t.conn.WriteToUDP(bencode.Encode(d), &addr)
+	return err
+}
+
+// reserve picks a transaction id not already in use by another
+// outstanding call and registers it atomically, so two concurrent Calls
+// can never collide and silently steal each other's pending entry. Ids
+// are 4 random bytes, wide enough that collisions among the thousands of
+// calls a crawl can have outstanding at once are effectively impossible.
+func (t *Transport) reserve() (string, *pendingCall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		buf := make([]byte, 4)
+		rand.Read(buf)
+		tid := string(buf)
+
+		if _, taken := t.pending[tid]; taken {
+			continue
+		}
+
+		call := &pendingCall{reply: make(chan *Response, 1), err: make(chan error, 1)}
+		t.pending[tid] = call
+		return tid, call
+	}
+}
+
+func encodeQuery(q *Query) []byte {
+	return bencode.Encode(map[string]interface{}{
+		"t": q.T,
+		"y": "q",
+		"q": q.Q,
+		"a": q.A,
+	})
+}
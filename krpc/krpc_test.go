@@ -0,0 +1,136 @@
+package krpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+func newLoopbackUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestCallTimeoutThenRetry drops the first attempt on the floor and only
+// answers the second, verifying Call retries after a timeout instead of
+// giving up after the first unanswered attempt.
+func TestCallTimeoutThenRetry(t *testing.T) {
+	peerConn := newLoopbackUDP(t)
+	defer peerConn.Close()
+
+	transportConn := newLoopbackUDP(t)
+	defer transportConn.Close()
+
+	transport := NewTransport(transportConn, 50*time.Millisecond, 1)
+	go transport.Listen()
+
+	go func() {
+		buf := make([]byte, 2048)
+
+		// First attempt: read it and deliberately don't reply, so Call
+		// has to time out and retry.
+		if _, _, err := peerConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+
+		// Second attempt: reply this time.
+		n, from, err := peerConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		dict, err := bencode.Decode(bytes.NewBuffer(buf[:n]))
+		if err != nil {
+			return
+		}
+		tid, _ := dict["t"].(string)
+
+		resp := bencode.Encode(map[string]interface{}{
+			"t": tid,
+			"y": "r",
+			"r": map[string]interface{}{"id": "ok"},
+		})
+		peerConn.WriteToUDP(resp, from)
+	}()
+
+	resp, err := transport.Call(context.Background(), *peerConn.LocalAddr().(*net.UDPAddr), "ping", map[string]interface{}{"id": "x"})
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if id, _ := resp.R["id"].(string); id != "ok" {
+		t.Fatalf("resp.R[%q] = %q, want %q", "id", id, "ok")
+	}
+}
+
+// TestCallCorrelatesReplyByTransactionID fires two concurrent Calls
+// against the same fake peer and checks each one gets back the reply
+// matching its own query, verifying replies are routed by transaction id
+// rather than, say, delivered to whichever Call happens to be waiting.
+func TestCallCorrelatesReplyByTransactionID(t *testing.T) {
+	peerConn := newLoopbackUDP(t)
+	defer peerConn.Close()
+
+	transportConn := newLoopbackUDP(t)
+	defer transportConn.Close()
+
+	transport := NewTransport(transportConn, time.Second, 0)
+	go transport.Listen()
+
+	const calls = 2
+	go func() {
+		buf := make([]byte, 2048)
+		for i := 0; i < calls; i++ {
+			n, from, err := peerConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			dict, err := bencode.Decode(bytes.NewBuffer(buf[:n]))
+			if err != nil {
+				return
+			}
+			tid, _ := dict["t"].(string)
+			a, _ := dict["a"].(map[string]interface{})
+
+			resp := bencode.Encode(map[string]interface{}{
+				"t": tid,
+				"y": "r",
+				"r": map[string]interface{}{"echo": a["v"]},
+			})
+			peerConn.WriteToUDP(resp, from)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	results := make([]string, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := transport.Call(context.Background(), *peerConn.LocalAddr().(*net.UDPAddr), "ping", map[string]interface{}{
+				"v": fmt.Sprintf("call-%d", i),
+			})
+			if err != nil {
+				t.Errorf("Call %d: %v", i, err)
+				return
+			}
+			results[i], _ = resp.R["echo"].(string)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < calls; i++ {
+		want := fmt.Sprintf("call-%d", i)
+		if results[i] != want {
+			t.Errorf("results[%d] = %q, want %q", i, results[i], want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/wanghui22718/torsniff/metawire"
+	"github.com/wanghui22718/torsniff/store"
+)
+
+func main() {
+	laddr := flag.String("addr", ":6881", "address to listen on for the DHT network")
+	friends := flag.Int("friends", 500, "max friends to make per second")
+	workers := flag.Int("workers", 32, "max concurrent metadata fetches")
+	timeout := flag.Duration("timeout", 10*time.Second, "per-peer metadata fetch timeout")
+	externalIP := flag.String("external-ip", "", "this node's external IPv4 address, used to derive a BEP 42 secure node id")
+	autodetectIP := flag.Bool("autodetect-ip", true, "when -external-ip is unset, learn it from bootstrap router replies")
+	requireSecureID := flag.Bool("require-secure-id", false, "reject get_peers/announce_peer queries from peers without a valid BEP 42 id (most real peers don't have one; leave this off to sniff the whole swarm)")
+	storeKind := flag.String("store", "jsonl", "where to persist resolved torrents: jsonl, sqlite, bolt, or none")
+	storePath := flag.String("store-path", "torsniff.jsonl", "path to the store's backing file")
+	adminAddr := flag.String("admin-addr", "", "address for the admin HTTP endpoint listing recent torrents (disabled if empty)")
+	flag.Parse()
+
+	var ip net.IP
+	if *externalIP != "" {
+		ip = net.ParseIP(*externalIP).To4()
+		if ip == nil {
+			log.Fatalf("-external-ip %q is not a valid IPv4 address", *externalIP)
+		}
+	}
+
+	g, err := newDHT(*laddr, *friends, ip, *autodetectIP, *requireSecureID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sink, err := openStore(*storeKind, *storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("admin endpoint listening on %s", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, store.AdminHandler(sink)); err != nil {
+				log.Printf("admin endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	sem := make(chan struct{}, *workers)
+	for ac := range g.Announcements() {
+		if has, err := sink.Has(ac.infohash); err == nil && has {
+			continue
+		}
+
+		sem <- struct{}{}
+		go func(ac *announcement) {
+			defer func() { <-sem }()
+			fetchMetadata(ac, *timeout, sink)
+		}(ac)
+	}
+}
+
+func openStore(kind, path string) (store.Store, error) {
+	switch kind {
+	case "sqlite":
+		inner, err := store.OpenSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewBatched(inner, 256), nil
+	case "bolt":
+		inner, err := store.OpenBolt(path)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewBatched(inner, 256), nil
+	case "jsonl":
+		inner, err := store.OpenJSONL(path)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewBatched(inner, 256), nil
+	case "none":
+		return store.Noop{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -store %q, want sqlite, bolt, jsonl, or none", kind)
+	}
+}
+
+// fetchMetadata resolves the torrent metadata for a sniffed announcement,
+// logs a summary of it, and persists it to sink. Fetches that time out or
+// fail are dropped silently, same as any other unresolvable announcement.
+func fetchMetadata(ac *announcement, timeout time.Duration, sink store.Store) {
+	info, err := metawire.Fetch(ac.infohash, ac.peer, timeout)
+	if err != nil {
+		return
+	}
+
+	log.Printf("torrent %s: %q (%d bytes, %d files)", ac.infohashHex, info.Name, info.Length, len(info.Files))
+
+	rec := &store.Record{
+		InfoHash: ac.infohashHex,
+		Name:     info.Name,
+		Length:   info.Length,
+		Peer:     ac.peer.String(),
+		Time:     time.Now(),
+	}
+	for _, f := range info.Files {
+		rec.Files = append(rec.Files, f.Path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := sink.Put(ctx, rec); err != nil {
+		log.Printf("store: failed to persist %s: %v", ac.infohashHex, err)
+	}
+}
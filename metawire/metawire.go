@@ -0,0 +1,349 @@
+// Package metawire implements the ut_metadata extension (BEP 9) on top of
+// the BitTorrent peer wire protocol, allowing a .torrent's info dictionary
+// to be fetched directly from a peer given only its infohash.
+package metawire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+const (
+	protocol = "BitTorrent protocol"
+
+	extHandshakeID = 0
+
+	msgTypeRequest = 0
+	msgTypeData    = 1
+	msgTypeReject  = 2
+
+	metadataPieceSize = 16 * 1024
+
+	// maxMetadataSize bounds how large a metadata_size we'll believe a
+	// peer's extension handshake: large enough for any real .torrent
+	// info dict, small enough that a lying peer can't make us allocate
+	// an unreasonable amount of memory.
+	maxMetadataSize = 10 * 1024 * 1024
+
+	// maxExtMessageSize bounds a single BT extended message's length
+	// prefix, read straight off the wire before we know anything about
+	// its contents: real extended messages (handshakes, metadata
+	// pieces) are at most metadataPieceSize plus a small bencoded
+	// header, so a few hundred KB is generous headroom without letting
+	// a peer force a multi-gigabyte allocation via a bogus length.
+	maxExtMessageSize = 256 * 1024
+
+	extensionBitIndex = 20 // bit 20 of the reserved 8 bytes signals BEP 10 support
+)
+
+var (
+	errNoExtensionSupport = errors.New("metawire: peer does not support the extension protocol")
+	errNoUTMetadata       = errors.New("metawire: peer does not support ut_metadata")
+	errChecksumMismatch   = errors.New("metawire: reassembled metadata does not match infohash")
+	errRejected           = errors.New("metawire: peer rejected a metadata piece request")
+	errMessageTooLarge    = errors.New("metawire: peer sent an implausibly large message")
+)
+
+// File describes a single file inside a (possibly multi-file) torrent.
+type File struct {
+	Path   string
+	Length int64
+}
+
+// Info is the parsed subset of a torrent's info dictionary that callers
+// care about.
+type Info struct {
+	InfoHash []byte
+	Name     string
+	Length   int64
+	Files    []File
+	Raw      map[string]interface{}
+}
+
+// Fetch dials peer, performs the BT handshake and BEP 10/9 extension
+// handshake, downloads every metadata piece, and returns the decoded info
+// dictionary. It verifies that the SHA1 of the reassembled metadata equals
+// infohash before returning it.
+func Fetch(infohash []byte, peer net.Addr, timeout time.Duration) (*Info, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := handshake(conn, infohash); err != nil {
+		return nil, err
+	}
+
+	peerUTMetadata, size, err := extHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := fetchPieces(conn, peerUTMetadata, size)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(raw)
+	if !bytes.Equal(sum[:], infohash) {
+		return nil, errChecksumMismatch
+	}
+
+	dict, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(infohash, dict), nil
+}
+
+func handshake(conn net.Conn, infohash []byte) error {
+	reserved := make([]byte, 8)
+	reserved[5] |= 1 << (extensionBitIndex % 8)
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(len(protocol)))
+	buf.WriteString(protocol)
+	buf.Write(reserved)
+	buf.Write(infohash)
+	buf.Write(randPeerID())
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 68)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+
+	if int(resp[0]) != len(protocol) || string(resp[1:1+len(protocol)]) != protocol {
+		return fmt.Errorf("metawire: unexpected handshake response")
+	}
+
+	if resp[25]&(1<<(extensionBitIndex%8)) == 0 {
+		return errNoExtensionSupport
+	}
+
+	if !bytes.Equal(resp[28:48], infohash) {
+		return fmt.Errorf("metawire: peer echoed a different infohash")
+	}
+
+	return nil
+}
+
+func extHandshake(conn net.Conn) (peerUTMetadata int64, metadataSize int64, err error) {
+	payload := bencode.Encode(map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": int64(1),
+		},
+	})
+
+	if err := sendExtMessage(conn, extHandshakeID, payload); err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		id, body, err := readExtMessage(conn)
+		if err != nil {
+			return 0, 0, err
+		}
+		if id != extHandshakeID {
+			continue
+		}
+
+		dict, err := bencode.Decode(bytes.NewReader(body))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		m, ok := dict["m"].(map[string]interface{})
+		if !ok {
+			return 0, 0, errNoUTMetadata
+		}
+
+		utMetadata, ok := m["ut_metadata"].(int64)
+		if !ok {
+			return 0, 0, errNoUTMetadata
+		}
+
+		size, ok := dict["metadata_size"].(int64)
+		if !ok {
+			return 0, 0, fmt.Errorf("metawire: peer did not advertise metadata_size")
+		}
+		if size <= 0 || size > maxMetadataSize {
+			return 0, 0, fmt.Errorf("metawire: peer advertised an unreasonable metadata_size %d", size)
+		}
+
+		return utMetadata, size, nil
+	}
+}
+
+func fetchPieces(conn net.Conn, peerUTMetadata int64, size int64) ([]byte, error) {
+	pieces := int((size + metadataPieceSize - 1) / metadataPieceSize)
+	raw := make([]byte, size)
+
+	for i := 0; i < pieces; i++ {
+		req := bencode.Encode(map[string]interface{}{
+			"msg_type": int64(msgTypeRequest),
+			"piece":    int64(i),
+		})
+		if err := sendExtMessage(conn, byte(peerUTMetadata), req); err != nil {
+			return nil, err
+		}
+
+		piece, data, err := readPiece(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		off := int64(piece) * metadataPieceSize
+		if off < 0 || off >= size {
+			return nil, fmt.Errorf("metawire: piece index %d out of range", piece)
+		}
+		copy(raw[off:], data)
+	}
+
+	return raw, nil
+}
+
+func readPiece(conn net.Conn) (piece int64, data []byte, err error) {
+	for {
+		id, body, err := readExtMessage(conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		if id == extHandshakeID {
+			continue
+		}
+
+		buf := bytes.NewBuffer(body)
+		dict, err := bencode.Decode(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		msgType, _ := dict["msg_type"].(int64)
+		switch msgType {
+		case msgTypeData:
+			p, _ := dict["piece"].(int64)
+			return p, buf.Bytes(), nil
+		case msgTypeReject:
+			return 0, nil, errRejected
+		default:
+			continue
+		}
+	}
+}
+
+// sendExtMessage writes a BT message of id 20 (extended) whose first
+// payload byte is the extended message id, per BEP 10.
+func sendExtMessage(conn net.Conn, extID byte, payload []byte) error {
+	msg := make([]byte, 0, 6+len(payload))
+	length := uint32(2 + len(payload))
+	lengthBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBuf, length)
+
+	msg = append(msg, lengthBuf...)
+	msg = append(msg, 20, extID)
+	msg = append(msg, payload...)
+
+	_, err := conn.Write(msg)
+	return err
+}
+
+// readExtMessage reads BT messages off conn until it finds an extended
+// message (id 20), skipping keep-alives and any other message types.
+func readExtMessage(conn net.Conn) (extID byte, payload []byte, err error) {
+	for {
+		lengthBuf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return 0, nil, err
+		}
+
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length == 0 {
+			continue // keep-alive
+		}
+		if length > maxExtMessageSize {
+			return 0, nil, errMessageTooLarge
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return 0, nil, err
+		}
+
+		if body[0] != 20 {
+			continue
+		}
+
+		return body[1], body[2:], nil
+	}
+}
+
+func parseInfo(infohash []byte, dict map[string]interface{}) *Info {
+	info := &Info{InfoHash: infohash, Raw: dict}
+
+	if name, ok := dict["name"].(string); ok {
+		info.Name = name
+	}
+
+	if length, ok := dict["length"].(int64); ok {
+		info.Length = length
+		return info
+	}
+
+	files, ok := dict["files"].([]interface{})
+	if !ok {
+		return info
+	}
+
+	for _, f := range files {
+		fd, ok := f.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		length, _ := fd["length"].(int64)
+		var parts []string
+		if path, ok := fd["path"].([]interface{}); ok {
+			for _, p := range path {
+				if s, ok := p.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+		}
+
+		file := File{Length: length}
+		for i, p := range parts {
+			if i > 0 {
+				file.Path += "/"
+			}
+			file.Path += p
+		}
+		info.Files = append(info.Files, file)
+		info.Length += length
+	}
+
+	return info
+}
+
+func randPeerID() []byte {
+	id := make([]byte, 20)
+	copy(id, "-TS0001-")
+	rand.Read(id[len("-TS0001-"):])
+	return id
+}
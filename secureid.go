@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+// secureIPv4Mask keeps only the bits of an IPv4 address that BEP 42
+// requires to survive into the node id, discarding the rest so a /24 (or
+// a handful of addresses near it) can't be farmed to land arbitrary ids
+// close to any given target.
+const secureIPv4Mask = 0x030f3fff
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// secureNodeID derives a BEP 42 node id for ip, using r as the id's
+// trailing "random" byte. r's low 3 bits are folded into the CRC input,
+// so a node can try a handful of values of r to search for a slightly
+// more favorable id, same as the reference implementation allows.
+func secureNodeID(ip net.IP, r byte) nodeID {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+
+	v := binary.BigEndian.Uint32(ip4)
+	v &= secureIPv4Mask
+	v |= uint32(r&0x7) << 29
+
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	crc := crc32.Checksum(buf[:], crc32cTable)
+
+	id := randBytes(20)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = (byte(crc>>8) & 0xf8) | (id[2] & 0x07)
+	id[19] = r
+
+	return id
+}
+
+// validSecureNodeID reports whether id is a valid BEP 42 id for ip, i.e.
+// it could have been produced by secureNodeID(ip, id[19]).
+func validSecureNodeID(id nodeID, ip net.IP) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	want := secureNodeID(ip, id[19])
+	return id[0] == want[0] && id[1] == want[1] && id[2]&0xf8 == want[2]&0xf8
+}
+
+// initialLocalID picks the node id a dht should start with: a BEP 42
+// secure id if we already know our external IP, or a plain random id
+// otherwise (callers that later learn their external IP should switch
+// to a secure id by calling secureNodeID themselves).
+func initialLocalID(externalIP net.IP) nodeID {
+	if externalIP == nil {
+		return randBytes(20)
+	}
+	return secureNodeID(externalIP, randBytes(1)[0])
+}
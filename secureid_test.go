@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSecureNodeIDRoundTrip(t *testing.T) {
+	ips := []string{
+		"1.2.3.4",
+		"86.124.236.5",
+		"203.0.113.77",
+	}
+
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		for r := 0; r < 8; r++ {
+			id := secureNodeID(ip, byte(r))
+			if !validSecureNodeID(id, ip) {
+				t.Errorf("secureNodeID(%s, %d) produced an id that doesn't validate against its own ip", ipStr, r)
+			}
+		}
+	}
+}
+
+func TestValidSecureNodeIDRejectsMismatchedIP(t *testing.T) {
+	id := secureNodeID(net.ParseIP("1.2.3.4"), 0)
+	if validSecureNodeID(id, net.ParseIP("5.6.7.8")) {
+		t.Fatal("id derived for one ip validated against a different ip")
+	}
+}
+
+func TestValidSecureNodeIDRejectsShortID(t *testing.T) {
+	if validSecureNodeID(nodeID{1, 2, 3}, net.ParseIP("1.2.3.4")) {
+		t.Fatal("a short id should never be reported valid")
+	}
+}
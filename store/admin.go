@@ -0,0 +1,38 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const defaultAdminListSize = 50
+
+// AdminHandler serves a JSON listing of the most recently persisted
+// torrents, for stores that implement Lister. The number of records can
+// be controlled with the "n" query parameter.
+func AdminHandler(s Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lister, ok := s.(Lister)
+		if !ok {
+			http.Error(w, "store does not support listing", http.StatusNotImplemented)
+			return
+		}
+
+		n := defaultAdminListSize
+		if v := r.URL.Query().Get("n"); v != "" {
+			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+				n = parsed
+			}
+		}
+
+		records, err := lister.Recent(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	})
+}
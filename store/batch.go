@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// maxBatchSize caps how many queued records Batched writes in a
+	// single PutBatch call.
+	maxBatchSize = 64
+	// flushInterval bounds how long a record can sit in the queue before
+	// Batched flushes whatever it's accumulated so far, even if
+	// maxBatchSize hasn't been reached.
+	flushInterval = 200 * time.Millisecond
+)
+
+// Batched wraps a Store so Put returns as soon as the record is queued;
+// a single background goroutine drains the queue and coalesces bursts of
+// announcements into batched writes via the inner store's PutBatch, if
+// it implements BatchPutter, instead of every caller contending for the
+// inner store directly. Inner stores without PutBatch fall back to one
+// Put per record.
+type Batched struct {
+	inner Store
+	queue chan *Record
+	done  chan struct{}
+}
+
+// NewBatched starts the background writer and returns a Store that
+// queues up to queueSize records before Put starts blocking.
+func NewBatched(inner Store, queueSize int) *Batched {
+	b := &Batched{
+		inner: inner,
+		queue: make(chan *Record, queueSize),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Batched) run() {
+	defer close(b.done)
+
+	batcher, _ := b.inner.(BatchPutter)
+
+	buf := make([]*Record, 0, maxBatchSize)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		b.write(batcher, buf)
+		buf = buf[:0]
+	}
+
+	for {
+		select {
+		case rec, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, rec)
+			if len(buf) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write persists buf via batcher's PutBatch if the inner store supports
+// it, otherwise falls back to one Put per record.
+func (b *Batched) write(batcher BatchPutter, buf []*Record) {
+	if batcher != nil {
+		if err := batcher.PutBatch(context.Background(), buf); err != nil {
+			log.Printf("store: failed to persist batch of %d records: %v", len(buf), err)
+		}
+		return
+	}
+
+	for _, rec := range buf {
+		if err := b.inner.Put(context.Background(), rec); err != nil {
+			log.Printf("store: failed to persist %s: %v", rec.InfoHash, err)
+		}
+	}
+}
+
+// Put implements Store.
+func (b *Batched) Put(ctx context.Context, rec *Record) error {
+	select {
+	case b.queue <- rec:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Has implements Store.
+func (b *Batched) Has(infohash []byte) (bool, error) {
+	return b.inner.Has(infohash)
+}
+
+// Recent implements Lister by delegating to the wrapped store; if the
+// wrapped store is not a Lister, it returns no records and no error.
+func (b *Batched) Recent(n int) ([]*Record, error) {
+	lister, ok := b.inner.(Lister)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Recent(n)
+}
+
+// Close drains the queue, waits for the writer to finish, then closes
+// the inner store.
+func (b *Batched) Close() error {
+	close(b.queue)
+	<-b.done
+	return b.inner.Close()
+}
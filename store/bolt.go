@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var torrentsBucket = []byte("torrents")
+
+// BoltStore persists records to a BoltDB file, keyed by hex infohash.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens (creating if needed) the BoltDB database at path.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(torrentsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Put implements Store.
+func (s *BoltStore) Put(ctx context.Context, rec *Record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(torrentsBucket)
+
+		key := []byte(rec.InfoHash)
+		if b.Get(key) != nil {
+			return nil
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(key, data)
+	})
+}
+
+// PutBatch implements BatchPutter, writing every record in recs inside a
+// single bolt transaction instead of one fsync'd transaction per record.
+func (s *BoltStore) PutBatch(ctx context.Context, recs []*Record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(torrentsBucket)
+
+		for _, rec := range recs {
+			key := []byte(rec.InfoHash)
+			if b.Get(key) != nil {
+				continue
+			}
+
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Has implements Store.
+func (s *BoltStore) Has(infohash []byte) (bool, error) {
+	var has bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		has = tx.Bucket(torrentsBucket).Get([]byte(hex.EncodeToString(infohash))) != nil
+		return nil
+	})
+	return has, err
+}
+
+// Recent implements Lister.
+func (s *BoltStore) Recent(n int) ([]*Record, error) {
+	var all []*Record
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(torrentsBucket).ForEach(func(_, v []byte) error {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			all = append(all, &rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Time.After(all[j].Time) })
+	if n < len(all) {
+		all = all[:n]
+	}
+
+	return all, nil
+}
+
+// Close implements Store.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// jsonlRecentLimit bounds how many records JSONLStore keeps in memory
+// for Recent; the on-disk file itself is never truncated.
+const jsonlRecentLimit = 200
+
+// JSONLStore is an append-only JSON-lines file. Its Has and Recent
+// answers come from an in-memory index built by replaying the file once
+// at open time.
+type JSONLStore struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	seen   map[string]bool
+	recent []*Record
+}
+
+// OpenJSONL opens (creating if needed) the JSONL file at path and
+// replays it to rebuild the in-memory index.
+func OpenJSONL(path string) (*JSONLStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &JSONLStore{
+		f:    f,
+		seen: make(map[string]bool),
+	}
+
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.enc = json.NewEncoder(f)
+	return s, nil
+}
+
+func (s *JSONLStore) replay() error {
+	dec := json.NewDecoder(s.f)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		s.seen[rec.InfoHash] = true
+		s.recent = append(s.recent, &rec)
+		if len(s.recent) > jsonlRecentLimit {
+			s.recent = s.recent[1:]
+		}
+	}
+
+	_, err := s.f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Put implements Store.
+func (s *JSONLStore) Put(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen[rec.InfoHash] {
+		return nil
+	}
+
+	if err := s.enc.Encode(rec); err != nil {
+		return err
+	}
+
+	s.seen[rec.InfoHash] = true
+	s.recent = append(s.recent, rec)
+	if len(s.recent) > jsonlRecentLimit {
+		s.recent = s.recent[1:]
+	}
+
+	return nil
+}
+
+// PutBatch implements BatchPutter, writing every record in recs under a
+// single lock acquisition instead of one per record.
+func (s *JSONLStore) PutBatch(ctx context.Context, recs []*Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rec := range recs {
+		if s.seen[rec.InfoHash] {
+			continue
+		}
+
+		if err := s.enc.Encode(rec); err != nil {
+			return err
+		}
+
+		s.seen[rec.InfoHash] = true
+		s.recent = append(s.recent, rec)
+		if len(s.recent) > jsonlRecentLimit {
+			s.recent = s.recent[1:]
+		}
+	}
+
+	return nil
+}
+
+// Has implements Store.
+func (s *JSONLStore) Has(infohash []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen[hex.EncodeToString(infohash)], nil
+}
+
+// Recent implements Lister.
+func (s *JSONLStore) Recent(n int) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.recent) {
+		n = len(s.recent)
+	}
+
+	out := make([]*Record, n)
+	copy(out, s.recent[len(s.recent)-n:])
+	return out, nil
+}
+
+// Close implements Store.
+func (s *JSONLStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS torrents (
+	infohash TEXT PRIMARY KEY,
+	name     TEXT,
+	length   INTEGER,
+	files    TEXT,
+	peer     TEXT,
+	seen_at  DATETIME
+)`
+
+// SQLiteStore persists records to a SQLite database via mattn/go-sqlite3.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (creating if needed) the SQLite database at path.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// Put implements Store.
+func (s *SQLiteStore) Put(ctx context.Context, rec *Record) error {
+	files, err := json.Marshal(rec.Files)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO torrents (infohash, name, length, files, peer, seen_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		rec.InfoHash, rec.Name, rec.Length, string(files), rec.Peer, rec.Time,
+	)
+	return err
+}
+
+// PutBatch implements BatchPutter, inserting every record in recs inside
+// a single transaction instead of one implicit commit per record.
+func (s *SQLiteStore) PutBatch(ctx context.Context, recs []*Record) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO torrents (infohash, name, length, files, peer, seen_at) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rec := range recs {
+		files, err := json.Marshal(rec.Files)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, rec.InfoHash, rec.Name, rec.Length, string(files), rec.Peer, rec.Time); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Has implements Store.
+func (s *SQLiteStore) Has(infohash []byte) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(1) FROM torrents WHERE infohash = ?`, hex.EncodeToString(infohash)).Scan(&n)
+	return n > 0, err
+}
+
+// Recent implements Lister.
+func (s *SQLiteStore) Recent(n int) ([]*Record, error) {
+	rows, err := s.db.Query(`SELECT infohash, name, length, files, peer, seen_at FROM torrents ORDER BY seen_at DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Record
+	for rows.Next() {
+		var rec Record
+		var files string
+		if err := rows.Scan(&rec.InfoHash, &rec.Name, &rec.Length, &files, &rec.Peer, &rec.Time); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(files), &rec.Files)
+		out = append(out, &rec)
+	}
+
+	return out, rows.Err()
+}
+
+// Close implements Store.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,55 @@
+// Package store persists torrents torsniff has resolved metadata for,
+// behind a small Store interface so the backing technology (SQLite,
+// BoltDB, a flat JSONL file, ...) can be swapped without touching the
+// sniffing pipeline.
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Record is what gets persisted for a single resolved torrent.
+type Record struct {
+	InfoHash string    `json:"infohash"`
+	Name     string    `json:"name"`
+	Length   int64     `json:"length"`
+	Files    []string  `json:"files,omitempty"`
+	Peer     string    `json:"peer"`
+	Time     time.Time `json:"time"`
+}
+
+// Store persists resolved torrents and answers whether a given infohash
+// has already been seen, so callers can skip redundant metadata fetches.
+type Store interface {
+	Put(ctx context.Context, rec *Record) error
+	Has(infohash []byte) (bool, error)
+	Close() error
+}
+
+// Lister is implemented by stores that can report their most recently
+// persisted records; the admin HTTP endpoint relies on it.
+type Lister interface {
+	Recent(n int) ([]*Record, error)
+}
+
+// BatchPutter is implemented by stores that can persist several records
+// in one transaction, cheaper than calling Put once per record. Batched
+// uses it when the wrapped store supports it, falling back to Put
+// otherwise.
+type BatchPutter interface {
+	PutBatch(ctx context.Context, recs []*Record) error
+}
+
+// Noop discards everything. It's the Store used when persistence is
+// turned off.
+type Noop struct{}
+
+// Put implements Store.
+func (Noop) Put(context.Context, *Record) error { return nil }
+
+// Has implements Store.
+func (Noop) Has([]byte) (bool, error) { return false, nil }
+
+// Close implements Store.
+func (Noop) Close() error { return nil }